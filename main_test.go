@@ -0,0 +1,1166 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	remoteerrors "github.com/containerd/containerd/remotes/errors"
+	"github.com/go-resty/resty/v2"
+	"github.com/ortelius/scec-commons/model"
+	toml "github.com/pelletier/go-toml/v2"
+)
+
+func TestNewClientRetriesServiceUnavailable(t *testing.T) {
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	client := newClient(&argT{Timeout: 5, Retries: 5, UploadRetries: 2})
+	resp, err := client.R().Post(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode() != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", resp.StatusCode(), http.StatusServiceUnavailable)
+	}
+
+	// The first attempt and the --upload-retries retries
+	if got := attempts.Load(); got != 3 {
+		t.Errorf("attempts = %d, want 3", got)
+	}
+}
+
+func TestGatherFileCRLF(t *testing.T) {
+	license := filepath.Join(t.TempDir(), "LICENSE")
+	if err := os.WriteFile(license, []byte("MIT License\r\n\r\nCopyright\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	fileOverrides[LicenseFile] = license
+	t.Cleanup(func() { delete(fileOverrides, LicenseFile) })
+
+	tests := []struct {
+		keepCR bool
+		want   []string
+	}{
+		{false, []string{"MIT License", "", "Copyright", ""}},
+		{true, []string{"MIT License\r", "\r", "Copyright\r", ""}},
+	}
+	for _, tt := range tests {
+		if got := gatherFile(LicenseFile, tt.keepCR); !slices.Equal(got, tt.want) {
+			t.Errorf("gatherFile(keepCR=%v) = %q, want %q", tt.keepCR, got, tt.want)
+		}
+	}
+}
+
+func TestConvertSBOMFileSPDX(t *testing.T) {
+	for _, skipValidation := range []bool{false, true} {
+		testConvertSBOMFileSPDX(t, skipValidation)
+	}
+}
+
+func testConvertSBOMFileSPDX(t *testing.T, skipValidation bool) {
+	converted, err := convertSBOMFile("testdata/sbom.spdx.json", skipValidation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(converted)
+	if converted == "testdata/sbom.spdx.json" {
+		t.Fatal("SPDX SBOM was not converted")
+	}
+
+	data, err := os.ReadFile(converted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bom struct {
+		BOMFormat  string `json:"bomFormat"`
+		Components []struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(data, &bom); err != nil {
+		t.Fatal(err)
+	}
+	if bom.BOMFormat != "CycloneDX" {
+		t.Errorf("bomFormat = %q, want CycloneDX", bom.BOMFormat)
+	}
+	found := false
+	for _, c := range bom.Components {
+		found = found || (c.Name == "zlib" && c.Version == "1.3.1")
+	}
+	if !found {
+		t.Errorf("converted SBOM has no zlib 1.3.1 component: %s", data)
+	}
+}
+
+func TestConvertSBOMFileCycloneDX(t *testing.T) {
+	converted, err := convertSBOMFile("testdata/sbom.cdx.json", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if converted != "testdata/sbom.cdx.json" {
+		t.Errorf("CycloneDX SBOM was converted to %s, want it returned unchanged", converted)
+	}
+}
+
+func TestConvertSBOMFileSkipValidation(t *testing.T) {
+	truncated := filepath.Join(t.TempDir(), "sbom.json")
+	if err := os.WriteFile(truncated, []byte(`{"bomFormat": "CycloneDX", "specVersion": "1.5", "components": [`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := convertSBOMFile(truncated, false); err == nil {
+		t.Error("truncated SBOM passed validation")
+	}
+	if converted, err := convertSBOMFile(truncated, true); err != nil || converted != truncated {
+		t.Errorf("convertSBOMFile(skipValidation) = %q, %v, want it returned unchanged", converted, err)
+	}
+}
+
+func TestNormalizeToml(t *testing.T) {
+	config := `
+Count = 3
+Ratio = 0.5
+Enabled = true
+Released = 2024-03-01T10:20:30Z
+Day = 2024-03-01
+Tags = ["a", 1, false]
+Matrix = [[1, 2], [3]]
+
+[Attributes]
+Port = 8080
+Nested = { a = 1 }
+`
+	var data map[interface{}]interface{}
+	if err := toml.Unmarshal([]byte(config), &data); err != nil {
+		t.Fatal(err)
+	}
+	normalizeToml(data)
+
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"Count", "3"},
+		{"Ratio", "0.5"},
+		{"Enabled", "true"},
+		{"Released", "2024-03-01T10:20:30Z"},
+		{"Day", "2024-03-01"},
+		{"Tags", "a,1,false"},
+	}
+	for _, tt := range tests {
+		if got, ok := data[tt.key].(string); !ok || got != tt.want {
+			t.Errorf("%s = %#v, want %q", tt.key, data[tt.key], tt.want)
+		}
+	}
+
+	attributes := data["Attributes"].(map[string]interface{})
+	if got := attributes["Port"]; got != "8080" {
+		t.Errorf("Attributes.Port = %#v, want \"8080\"", got)
+	}
+
+	// Nested arrays and tables can't be represented as a string
+	if _, found := data["Matrix"]; found {
+		t.Error("Matrix was not dropped")
+	}
+	if _, found := attributes["Nested"]; found {
+		t.Error("Attributes.Nested was not dropped")
+	}
+}
+
+func TestPRRangeGitHub(t *testing.T) {
+	event := filepath.Join(t.TempDir(), "event.json")
+	payload := `{"pull_request": {"base": {"sha": "1111111"}, "head": {"sha": "2222222"}}}`
+	if err := os.WriteFile(event, []byte(payload), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GITLAB_CI", "")
+	t.Setenv("GITHUB_ACTIONS", "true")
+	t.Setenv("GITHUB_EVENT_NAME", "pull_request")
+	t.Setenv("GITHUB_EVENT_PATH", event)
+
+	if base, head := prRange(); base != "1111111" || head != "2222222" {
+		t.Errorf("prRange() = %q, %q, want 1111111, 2222222", base, head)
+	}
+
+	t.Setenv("GITHUB_EVENT_NAME", "push")
+	if base, head := prRange(); base != "" || head != "" {
+		t.Errorf("prRange() outside a pull request = %q, %q, want empty", base, head)
+	}
+}
+
+func TestPRRangeGitLab(t *testing.T) {
+	t.Setenv("GITHUB_ACTIONS", "")
+	t.Setenv("GITLAB_CI", "true")
+	t.Setenv("CI_MERGE_REQUEST_IID", "42")
+	t.Setenv("CI_MERGE_REQUEST_DIFF_BASE_SHA", "3333333")
+	t.Setenv("CI_MERGE_REQUEST_SOURCE_BRANCH_SHA", "4444444")
+
+	if base, head := prRange(); base != "3333333" || head != "4444444" {
+		t.Errorf("prRange() = %q, %q, want 3333333, 4444444", base, head)
+	}
+
+	t.Setenv("CI_MERGE_REQUEST_IID", "")
+	if base, head := prRange(); base != "" || head != "" {
+		t.Errorf("prRange() outside a merge request = %q, %q, want empty", base, head)
+	}
+}
+
+func TestPostStreamCompressed(t *testing.T) {
+	compressAll = true
+	t.Cleanup(func() { compressAll = false })
+
+	var encoding string
+	var received []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding = r.Header.Get("Content-Encoding")
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Error(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if received, err = io.ReadAll(gz); err != nil {
+			t.Error(err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"_key": "sbom1"}`))
+	}))
+	defer server.Close()
+
+	content := `{"bomFormat": "CycloneDX", "components": []}`
+	key, err := postStream(newClient(&argT{Timeout: 5}), server.URL, "SBOM", "compver1", strings.NewReader(content), int64(len(content)), 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "sbom1" {
+		t.Errorf("key = %q, want sbom1", key)
+	}
+	if encoding != "gzip" {
+		t.Errorf("Content-Encoding = %q, want gzip", encoding)
+	}
+	if want := `{"_key":"compver1","objtype":"SBOM","content":` + content + "}"; string(received) != want {
+		t.Errorf("decompressed body = %s, want %s", received, want)
+	}
+}
+
+func TestPostDocumentCompressed(t *testing.T) {
+	var encoding string
+	var received []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding = r.Header.Get("Content-Encoding")
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Error(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if received, err = io.ReadAll(gz); err != nil {
+			t.Error(err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"_key": "sbom1"}`))
+	}))
+	defer server.Close()
+
+	doc := map[string]string{"_key": "compver1", "objtype": "SBOM"}
+	key, err := postDocumentWith(newClient(&argT{Timeout: 5}), server.URL, doc, map[string]string{"Content-Encoding": "gzip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "sbom1" {
+		t.Errorf("key = %q, want sbom1", key)
+	}
+	if encoding != "gzip" {
+		t.Errorf("Content-Encoding = %q, want gzip", encoding)
+	}
+	if want := `{"_key":"compver1","objtype":"SBOM"}`; string(received) != want {
+		t.Errorf("decompressed body = %s, want %s", received, want)
+	}
+}
+
+func TestGzipReaderClose(t *testing.T) {
+	// Closed before anything is read like a request that fails before sending the body
+	gz := gzipReader(bytes.NewReader(make([]byte, 1<<20)))
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gz.Read(make([]byte, 1)); !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("Read() after Close = %v, want %v", err, io.ErrClosedPipe)
+	}
+}
+
+func TestLoadConsoleTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	caCert := filepath.Join(t.TempDir(), "ca.pem")
+	bundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caCert, bundle, 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { consoleTLS = nil })
+
+	tests := []struct {
+		name    string
+		caCert  string
+		trusted bool
+	}{
+		{"with --cacert", caCert, true},
+		{"without --cacert", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var err error
+			if consoleTLS, err = loadConsoleTLS(tt.caCert, false); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = newClient(&argT{Timeout: 5}).R().Get(server.URL)
+			if tt.trusted && err != nil {
+				t.Errorf("request failed with the CA trusted: %v", err)
+			}
+			if !tt.trusted && err == nil {
+				t.Error("request succeeded without trusting the CA")
+			}
+		})
+	}
+}
+
+func TestValidateCompverVariant(t *testing.T) {
+	tests := []struct {
+		variant string
+		valid   bool
+	}{
+		{"", true},
+		{"main", true},
+		{"feature/x", true},
+		{"release-1.2_rc", true},
+		{"has space", false},
+		{"-leading", false},
+	}
+	for _, tt := range tests {
+		compver := model.NewComponentVersionDetails()
+		compver.Name, compver.Version, compver.Variant = "comp", "1.0.0", tt.variant
+		if err := validateCompver(compver); (err == nil) != tt.valid {
+			t.Errorf("validateCompver(variant %q) = %v, want valid %v", tt.variant, err, tt.valid)
+		}
+	}
+}
+
+func TestChildArgsDropsPassword(t *testing.T) {
+	args := os.Args
+	t.Cleanup(func() { os.Args = args })
+
+	os.Args = []string{"ortelius", "--discover", "--pass", "-", "--user=admin", "--pass=secret", "--run-timeout=60"}
+	want := []string{"--user=admin"}
+	if got := childArgs(discoverFlags); !slices.Equal(got, want) {
+		t.Errorf("childArgs() = %q, want %q", got, want)
+	}
+}
+
+// notModifiedServer answers a conditional post with 304 Not Modified without a key, and an unconditional one with
+// the key sbom1, or 304 again when always is set.  Counts the posts.
+func notModifiedServer(t *testing.T, always bool, posts *atomic.Int32) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posts.Add(1)
+		if _, err := io.ReadAll(r.Body); err != nil {
+			t.Error(err)
+		}
+		if always || len(r.Header.Get("If-None-Match")) > 0 {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"_key": "sbom1"}`))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestPostNotModifiedWithoutKey(t *testing.T) {
+	content := `{"bomFormat": "CycloneDX"}`
+	posters := []struct {
+		name string
+		post func(client *resty.Client, endpoint string) (string, error)
+	}{
+		{"postDocument", func(client *resty.Client, endpoint string) (string, error) {
+			return postDocument(client, endpoint, json.RawMessage(content))
+		}},
+		{"postStream", func(client *resty.Client, endpoint string) (string, error) {
+			return postStream(client, endpoint, "SBOM", "compver1", strings.NewReader(content), int64(len(content)), 0, `"etag"`)
+		}},
+	}
+	for _, p := range posters {
+		t.Run(p.name, func(t *testing.T) {
+			var posts atomic.Int32
+			server := notModifiedServer(t, false, &posts)
+			key, err := p.post(newClient(&argT{Timeout: 5}), server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if key != "sbom1" || posts.Load() != 2 {
+				t.Errorf("key = %q after %d posts, want sbom1 after 2", key, posts.Load())
+			}
+
+			posts.Store(0)
+			server = notModifiedServer(t, true, &posts)
+			if _, err := p.post(newClient(&argT{Timeout: 5}), server.URL); err == nil {
+				t.Error("post answered 304 without a key succeeded")
+			}
+			if posts.Load() != 2 {
+				t.Errorf("posts = %d, want 2", posts.Load())
+			}
+		})
+	}
+}
+
+func TestFindManifests(t *testing.T) {
+	root := t.TempDir()
+	for _, file := range []string{"a/component.toml", "b/component.yml", "c/component.yaml", "c/component.toml", "d/.ortelius.yml", "node_modules/e/component.toml"} {
+		if err := os.MkdirAll(filepath.Join(root, filepath.Dir(file)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, file), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	manifests, err := findManifests(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []manifest{
+		{filepath.Join(root, "a"), "component.toml", "toml"},
+		{filepath.Join(root, "b"), "component.yml", "yaml"},
+		{filepath.Join(root, "c"), "component.toml", "toml"},
+		{filepath.Join(root, "d"), ".ortelius.yml", "yaml"},
+	}
+	if !slices.Equal(manifests, want) {
+		t.Errorf("findManifests() = %v, want %v", manifests, want)
+	}
+}
+
+func TestRetryPolicyTransientErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		attempts int
+	}{
+		{"not found", fmt.Errorf("localhost:5000/x:latest: %w", errdefs.ErrNotFound), 1},
+		{"rejected credentials", withStatus(outcomeAuthFailed, "image", errors.New("401 Unauthorized")), 1},
+		{"unavailable", remoteerrors.ErrUnexpectedStatus{Status: "503 Service Unavailable", StatusCode: http.StatusServiceUnavailable}, 3},
+		{"fetch unavailable", errors.New("unexpected status code https://localhost:5000/v2/x/manifests/latest: 502 Bad Gateway"), 3},
+		{"connection refused", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, 3},
+	}
+	for _, tt := range tests {
+		attempts := 0
+		err := retryPolicy{count: 2}.do("localhost:5000/x:latest", func() error {
+			attempts++
+			return tt.err
+		})
+		if err == nil || attempts != tt.attempts {
+			t.Errorf("%s: %d attempts, err %v, want %d attempts", tt.name, attempts, err, tt.attempts)
+		}
+	}
+}
+
+// git runs git in the working directory and fails the test on an error
+func git(t *testing.T, args ...string) string {
+	t.Helper()
+	output, err := exec.Command("git", args...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, output)
+	}
+	return strings.TrimSpace(string(output))
+}
+
+func TestCommitSignatureSSH(t *testing.T) {
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Skip("ssh-keygen is not installed")
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.Chdir(cwd) })
+
+	allowed := make(map[string]string)
+	for _, name := range []string{"signer", "other"} {
+		if output, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-f", filepath.Join(dir, name)).CombinedOutput(); err != nil {
+			t.Fatalf("ssh-keygen: %v\n%s", err, output)
+		}
+		pub, err := os.ReadFile(filepath.Join(dir, name+".pub"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		allowed[name] = filepath.Join(dir, name+".allowed")
+		if err := os.WriteFile(allowed[name], []byte(name+"@example.com "+string(pub)), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	git(t, "init", "-q")
+	git(t, "config", "user.name", "Signer")
+	git(t, "config", "user.email", "signer@example.com")
+	git(t, "config", "gpg.format", "ssh")
+	git(t, "config", "user.signingkey", filepath.Join(dir, "signer.pub"))
+	git(t, "commit", "-q", "-S", "--allow-empty", "-m", "signed")
+
+	// The same commit with another message no longer matches its signature
+	tampered := filepath.Join(dir, "tampered")
+	if err := os.WriteFile(tampered, []byte(strings.Replace(git(t, "cat-file", "commit", "HEAD"), "signed", "changed", 1)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	bad := git(t, "hash-object", "-t", "commit", "-w", tampered)
+
+	tests := []struct {
+		name           string
+		commit         string
+		allowedSigners string
+		status         string
+		signer         string
+	}{
+		{"allowed signer", "HEAD", allowed["signer"], signatureTrusted, "signer@example.com"},
+		{"other signer", "HEAD", allowed["other"], signatureUntrusted, ""},
+		{"no allowed signers", "HEAD", "", signatureUntrusted, ""},
+		{"tampered", bad, allowed["signer"], signatureBad, ""},
+	}
+	for _, tt := range tests {
+		status, _, signer := commitSignature(tt.commit, tt.allowedSigners)
+		if status != tt.status || signer != tt.signer {
+			t.Errorf("%s: commitSignature() = %q, %q, want %q, %q", tt.name, status, signer, tt.status, tt.signer)
+		}
+	}
+
+	// SSH signatures have no "Signature made" line, the derived flag follows the status
+	mapping := make(map[string]string)
+	getGitDerived(&argT{AllowedSigners: allowed["signer"]}, mapping, nil, false, false)
+	if mapping["GIT_SIGNATURE_STATUS"] != signatureTrusted || mapping["GIT_VERIFY_COMMIT"] != "1" {
+		t.Errorf("GIT_SIGNATURE_STATUS = %q, GIT_VERIFY_COMMIT = %q, want %q, 1", mapping["GIT_SIGNATURE_STATUS"], mapping["GIT_VERIFY_COMMIT"], signatureTrusted)
+	}
+}
+
+func TestApplyCLIAttrs(t *testing.T) {
+	t.Setenv(attrEnvPrefix+"RISK", "2")
+	t.Setenv(attrEnvPrefix+"TEAM", "payments")
+
+	attrs := model.NewCompAttrs()
+	tomlVars := map[string]string{"RISK": "1", "TEAM": "core", "TIER": "gold"}
+	if err := applyCLIAttrs([]string{"risk=3"}, attrs, tomlVars); err != nil {
+		t.Fatal(err)
+	}
+
+	// --attr wins over the environment, which wins over the component.toml
+	want := map[string]string{"RISK": "3", "TEAM": "payments", "TIER": "gold"}
+	for key, value := range want {
+		if tomlVars[key] != value {
+			t.Errorf("%s = %q, want %q", key, tomlVars[key], value)
+		}
+	}
+	if attrs.Additional["RISK"] != "3" || attrs.Additional["TEAM"] != "payments" {
+		t.Errorf("Additional = %v, want RISK=3 and TEAM=payments", attrs.Additional)
+	}
+
+	for _, spec := range []string{"DockerTag=1.0", "name=other", "novalue", "=value"} {
+		if err := applyCLIAttrs([]string{spec}, model.NewCompAttrs(), make(map[string]string)); err == nil {
+			t.Errorf("applyCLIAttrs(%q) succeeded", spec)
+		}
+	}
+}
+
+func TestLoadJSONEvidenceReservedNames(t *testing.T) {
+	report := filepath.Join(t.TempDir(), "report.json")
+	if err := os.WriteFile(report, []byte(`{"passed": true}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	reserved := map[string]string{"buildlog": "--build-log", "manifests": "--chart-dir"}
+
+	evidence, err := loadJSONEvidence([]string{"tests=" + report}, reserved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(evidence) != 1 || evidence[0].Name != "tests" {
+		t.Errorf("evidence = %v, want the tests document", evidence)
+	}
+
+	for _, specs := range [][]string{{"manifests=" + report}, {"buildlog=" + report}, {"tests=" + report, "tests=" + report}} {
+		if _, err := loadJSONEvidence(specs, reserved); err == nil {
+			t.Errorf("loadJSONEvidence(%q) succeeded", specs)
+		}
+	}
+}
+
+func TestFetchCompverNotFound(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		wantErr     bool
+	}{
+		{"no component version", "application/json", `{"error": "not found"}`, false},
+		{"no lookup endpoint", "text/plain; charset=utf-8", "404 page not found", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.WriteHeader(http.StatusNotFound)
+				_, _ = w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			// The console port is appended to the URL, every connection goes to the test server instead
+			client := newClient(&argT{Timeout: 5}).SetTransport(&http.Transport{
+				DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, network, server.Listener.Addr().String())
+				},
+			})
+			compver := model.NewComponentVersionDetails()
+			compver.Name, compver.Version = "comp", "1.0.0"
+			previous, err := fetchCompver(client, "http://console", compver)
+			if (err != nil) != tt.wantErr || previous != nil {
+				t.Errorf("fetchCompver() = %v, %v, want nil and error %v", previous, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReadProvenanceFile(t *testing.T) {
+	statement := `{"_type": "https://in-toto.io/Statement/v1"}`
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"provenance.json", statement, statement},
+		{"single.intoto.jsonl", statement + "\n", "[" + statement + "]"},
+		{"multiple.intoto.jsonl", statement + "\n" + statement + "\n", "[" + statement + "," + statement + "]"},
+		{"multiple.txt", statement + "\n" + statement + "\n", "[" + statement + "," + statement + "]"},
+	}
+	for _, tt := range tests {
+		filename := filepath.Join(t.TempDir(), tt.name)
+		if err := os.WriteFile(filename, []byte(tt.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		got, err := readProvenanceFile(filename)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		var compact, want bytes.Buffer
+		if err := json.Compact(&compact, got); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		_ = json.Compact(&want, []byte(tt.want))
+		if compact.String() != want.String() {
+			t.Errorf("%s: readProvenanceFile() = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestStreamAuthorsLongLine(t *testing.T) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.Chdir(cwd) })
+
+	// The message line is longer than any scanner buffer
+	message := filepath.Join(dir, "message")
+	if err := os.WriteFile(message, []byte(strings.Repeat("x", 2*1024*1024)), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	git(t, "init", "-q")
+	git(t, "-c", "user.name=Dev", "-c", "user.email=dev@example.com", "commit", "-q", "--allow-empty", "-m", "first")
+	git(t, "-c", "user.name=Long", "-c", "user.email=long@example.com", "commit", "-q", "--allow-empty", "-F", message)
+	git(t, "-c", "user.name=Bot", "-c", "user.email=bot@example.com", "commit", "-q", "--allow-empty", "-m", "last")
+
+	if got, want := streamAuthors([]string{"bot@"}, "log"), "dev@example.com,long@example.com"; got != want {
+		t.Errorf("streamAuthors() = %q, want %q", got, want)
+	}
+}
+
+func TestProxyErrorAuthRequired(t *testing.T) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusProxyAuthRequired)
+	}))
+	defer proxy.Close()
+
+	consoleProxy = proxy.URL
+	t.Cleanup(func() { consoleProxy = "" })
+
+	_, err := newClient(&argT{Timeout: 5}).R().Get("https://console.example.com")
+	if err == nil {
+		t.Fatal("request through the proxy succeeded")
+	}
+	if err := proxyError(err); !strings.Contains(err.Error(), "the proxy requires authentication") {
+		t.Errorf("proxyError() = %v, want the proxy authentication hint", err)
+	}
+}
+
+func TestValidateURL(t *testing.T) {
+	for raw, want := range map[string]string{
+		"https://console.example.com/": "",
+		"192.168.1.1:8080":             "missing http:// or https:// scheme, use --url=http://192.168.1.1",
+		"localhost:8080":               "missing http:// or https:// scheme, use --url=http://localhost",
+		"console.example.com":          "missing http:// or https:// scheme, use --url=http://console.example.com",
+		"ftp://console.example.com":    "unsupported scheme ftp",
+		"http://localhost:8080":        "the service ports are added by the CLI",
+	} {
+		_, err := validateURL(raw)
+		switch {
+		case len(want) == 0 && err != nil:
+			t.Errorf("validateURL(%q) = %v, want no error", raw, err)
+		case len(want) > 0 && (err == nil || !strings.Contains(err.Error(), want)):
+			t.Errorf("validateURL(%q) = %v, want an error containing %q", raw, err, want)
+		}
+	}
+}
+
+func TestWriteGitHubOutputPrefix(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "output")
+	t.Setenv("GITHUB_OUTPUT", filename)
+	t.Cleanup(func() { githubOutputPrefix = "" })
+
+	for _, component := range []string{".", "services/api", "services/web.ui"} {
+		githubOutputPrefix = ""
+		if component != "." {
+			githubOutputPrefix = outputPrefix(component)
+		}
+		writeGitHubOutput(map[string]string{"compver_key": component})
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "compver_key=.\nservices_api_compver_key=services/api\nservices_web_ui_compver_key=services/web.ui\n"; string(data) != want {
+		t.Errorf("GITHUB_OUTPUT = %q, want %q", data, want)
+	}
+}
+
+// fakeConsole answers every post with a new key and a login token, as reached through it as the proxy so the
+// service ports need no listeners.  Returns the bodies posted.
+func fakeConsole(t *testing.T) func() []string {
+	var mu sync.Mutex
+	var bodies []string
+	console := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{}`))
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, string(body))
+		fmt.Fprintf(w, `{"_key": "key%d", "token": "token"}`, len(bodies))
+		mu.Unlock()
+	}))
+	t.Cleanup(console.Close)
+
+	consoleProxy = console.URL
+	t.Cleanup(func() { consoleProxy = "" })
+
+	return func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(bodies)
+	}
+}
+
+// discoverTree changes to a new directory with a component.toml in a directory for each component, ${COMPONENT} in
+// config is replaced with the directory name
+func discoverTree(t *testing.T, config string, components ...string) string {
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.Chdir(cwd) })
+
+	for _, component := range components {
+		if err := os.Mkdir(component, 0700); err != nil {
+			t.Fatal(err)
+		}
+		content := strings.ReplaceAll(config, "${COMPONENT}", component)
+		if err := os.WriteFile(filepath.Join(component, "component.toml"), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestDiscoverComponentsGitHubOutput(t *testing.T) {
+	fakeConsole(t)
+	discoverTree(t, "Application = \"GLOBAL.app\"\nName = \"GLOBAL.${COMPONENT}\"\nVersion = \"1.0.0\"\n", "api", "web")
+
+	output := filepath.Join(t.TempDir(), "output")
+	t.Setenv("GITHUB_OUTPUT", output)
+
+	argv := &argT{URL: "http://console", UserID: "admin", Password: "admin", APIBase: "/msapi", Output: "text", Timeout: 5, Discover: true}
+	if err := discoverComponents(argv); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"api_compver_key=key", "web_compver_key=key"} {
+		if !strings.Contains(string(data), name) {
+			t.Errorf("GITHUB_OUTPUT is missing %s:\n%s", name, data)
+		}
+	}
+	if strings.Contains(string(data), "\ncompver_key=") || strings.HasPrefix(string(data), "compver_key=") {
+		t.Errorf("GITHUB_OUTPUT has an unprefixed compver_key:\n%s", data)
+	}
+}
+
+func TestDiscoverComponentsIsolated(t *testing.T) {
+	posted := fakeConsole(t)
+	root := discoverTree(t, "Application = \"GLOBAL.app\"\nName = \"GLOBAL.${BASENAME}\"\nVersion = \"1.0.0\"\n", "api", "web")
+	t.Cleanup(func() { os.Unsetenv("BASENAME") })
+
+	argv := &argT{URL: "http://console", UserID: "admin", Password: "admin", APIBase: "/msapi", Output: "text", Timeout: 5, Discover: true, KeyFile: "keys"}
+	if err := discoverComponents(argv); err != nil {
+		t.Fatal(err)
+	}
+
+	bodies := strings.Join(posted(), "\n")
+	for _, name := range []string{`"name":"api"`, `"name":"web"`} {
+		if !strings.Contains(bodies, name) {
+			t.Errorf("no component version named %s was posted:\n%s", name, bodies)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "keys")); err != nil {
+		t.Errorf("--key-file was not written in the working directory: %v", err)
+	}
+	if _, ok := os.LookupEnv("BASENAME"); ok {
+		t.Error("BASENAME of the last component is left in the environment")
+	}
+}
+
+func TestGatherEvidenceSBOMSigFailedKeepGoing(t *testing.T) {
+	posted := fakeConsole(t)
+	dir := discoverTree(t, "")
+	files := map[string]string{
+		"component.toml":   "Application = \"GLOBAL.app\"\nName = \"GLOBAL.api\"\nVersion = \"1.0.0\"\n",
+		"sbom.json":        `{"bomFormat": "CycloneDX", "specVersion": "1.5", "components": []}`,
+		"sbom.sig":         base64.StdEncoding.EncodeToString(make([]byte, ed25519.SignatureSize)),
+		"requirements.txt": "requests==2.31.0\n",
+	}
+	public, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files["sbom.pub"] = string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	argv := &argT{URL: "http://console", UserID: "admin", Password: "admin", APIBase: "/msapi", Output: "text", Timeout: 5,
+		KeepGoing: true, SBOMs: []string{"sbom.json"}, SBOMSig: "sbom.sig", SBOMVerifyKey: "sbom.pub", SBOMFromLockfiles: true}
+	if err := gatherEvidence(argv); err != nil {
+		t.Fatal(err)
+	}
+
+	// Neither the SBOM that failed to verify nor the unsigned lockfile SBOM is uploaded in its place
+	for _, body := range posted() {
+		if strings.Contains(body, `"objtype":"SBOM"`) {
+			t.Errorf("an SBOM was uploaded after the signature failed to verify: %.200s", body)
+		}
+		if strings.Contains(body, `"objtype":"ComponentVersionDetails"`) && !strings.Contains(body, `"SBOM_STATUS"`) {
+			t.Errorf("the component version has no SBOM_STATUS: %.200s", body)
+		}
+	}
+}
+
+func TestGatherEvidenceDiffRedacted(t *testing.T) {
+	fakeConsole(t)
+	dir := discoverTree(t, "")
+	config := "Application = \"GLOBAL.app\"\nName = \"GLOBAL.api\"\nVersion = \"1.0.0\"\nGIT_URL = \"https://git.corp.example.com/team/api.git\"\n"
+	if err := os.WriteFile(filepath.Join(dir, "component.toml"), []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = w
+	t.Cleanup(func() { os.Stdout = stdout })
+
+	argv := &argT{URL: "http://console", UserID: "admin", Password: "admin", APIBase: "/msapi", Output: "text", Timeout: 5,
+		Diff: true, RedactHosts: []string{"*.corp.example.com"}}
+	err = gatherEvidence(argv)
+	w.Close()
+	os.Stdout = stdout
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(output), "git.corp.example.com") || !strings.Contains(string(output), "REDACTED") {
+		t.Errorf("--diff shows the unredacted git url:\n%s", output)
+	}
+}
+
+func TestPostStreamRetries(t *testing.T) {
+	content := `{"bomFormat": "CycloneDX", "components": []}`
+	want := `{"_key":"compver1","objtype":"SBOM","content":` + content + "}"
+
+	for _, tt := range []struct {
+		name     string
+		content  io.Reader
+		attempts int32
+	}{
+		{"rewindable", strings.NewReader(content), 2},
+		{"stream", io.MultiReader(strings.NewReader(content)), 1},
+	} {
+		var attempts atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			if attempts.Add(1) == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			if string(body) != want {
+				t.Errorf("%s: retried body = %s, want %s", tt.name, body, want)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"_key": "sbom1"}`))
+		}))
+
+		client := newClient(&argT{Timeout: 5, Retries: 2, UploadRetries: -1})
+		key, err := postStream(client, server.URL, "SBOM", "compver1", tt.content, int64(len(content)), 0, "")
+		server.Close()
+
+		if got := attempts.Load(); got != tt.attempts {
+			t.Errorf("%s: %d attempts, want %d", tt.name, got, tt.attempts)
+		}
+		if tt.attempts > 1 && (err != nil || key != "sbom1") {
+			t.Errorf("%s: postStream() = %q, %v, want sbom1", tt.name, key, err)
+		}
+		if tt.attempts == 1 && err == nil {
+			t.Errorf("%s: postStream() succeeded after the stream was sent once", tt.name)
+		}
+	}
+}
+
+func TestSBOMETag(t *testing.T) {
+	first := `{"bomFormat": "CycloneDX", "serialNumber": "urn:uuid:1", "metadata": {"timestamp": "2024-01-01T00:00:00Z"}, "components": [{"purl": "pkg:npm/a@1"}, {"purl": "pkg:npm/b@1"}]}`
+	second := `{"bomFormat": "CycloneDX", "serialNumber": "urn:uuid:2", "metadata": {"timestamp": "2024-01-02T00:00:00Z"}, "components": [{"purl": "pkg:npm/b@1"}, {"purl": "pkg:npm/a@1"}]}`
+	if a, b := sbomETag([]byte(first)), sbomETag([]byte(second)); a != b {
+		t.Errorf("sbomETag() of two scans = %s and %s, want the same", a, b)
+	}
+
+	digest, err := sbomDigest([]byte(first))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := sbomETag([]byte(first)), `"`+strings.TrimPrefix(digest, "sha256:")+`"`; got != want {
+		t.Errorf("sbomETag() = %s, want %s", got, want)
+	}
+
+	if got, want := sbomETag([]byte("not json")), `"`+fmt.Sprintf("%x", sha256.Sum256([]byte("not json")))+`"`; got != want {
+		t.Errorf("sbomETag() of invalid JSON = %s, want the content hash %s", got, want)
+	}
+}
+
+func TestGatherEvidenceAdditionalSBOMs(t *testing.T) {
+	posted := fakeConsole(t)
+	dir := discoverTree(t, "")
+	files := map[string]string{
+		"component.toml": "Application = \"GLOBAL.app\"\nName = \"GLOBAL.api\"\nVersion = \"1.0.0\"\n",
+		"app.json":       `{"bomFormat": "CycloneDX", "specVersion": "1.5", "components": [{"name": "app"}]}`,
+		"base.json":      `{"bomFormat": "CycloneDX", "specVersion": "1.5", "components": [{"name": "base"}]}`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	argv := &argT{URL: "http://console", UserID: "admin", Password: "admin", APIBase: "/msapi", Output: "text", Timeout: 5, SBOMs: []string{"app.json,base.json"}}
+	if err := gatherEvidence(argv); err != nil {
+		t.Fatal(err)
+	}
+
+	// The base SBOM is the one posted after the app SBOM, its key is linked as evidence
+	bodies := posted()
+	sbomKeys := make([]string, 0)
+	for i, body := range bodies {
+		if strings.Contains(body, `"objtype":"SBOM"`) {
+			sbomKeys = append(sbomKeys, fmt.Sprintf("key%d", i+1))
+		}
+	}
+	if len(sbomKeys) != 2 {
+		t.Fatalf("%d SBOMs were posted, want 2", len(sbomKeys))
+	}
+	want := `"name":"additional-sboms"`
+	link := `"content":[{"name":"base.json","key":"` + sbomKeys[1] + `"}]`
+	for _, body := range bodies {
+		if strings.Contains(body, want) {
+			if !strings.Contains(body, link) {
+				t.Errorf("additional-sboms evidence = %s, want %s", body, link)
+			}
+			return
+		}
+	}
+	t.Errorf("no additional-sboms evidence was posted")
+}
+
+func TestFirstCommitDate(t *testing.T) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.Chdir(cwd) })
+
+	git(t, "init", "-q")
+	git(t, "config", "user.name", "Dev")
+	git(t, "config", "user.email", "dev@example.com")
+	for _, c := range []struct{ dir, date string }{{"other", "2020-01-01T00:00:00Z"}, {"api", "2022-01-01T00:00:00Z"}, {"api", "2023-01-01T00:00:00Z"}} {
+		if err := os.MkdirAll(c.dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(c.dir, c.date), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+		git(t, "add", ".")
+		cmd := exec.Command("git", "commit", "-q", "-m", c.date)
+		cmd.Env = append(os.Environ(), "GIT_COMMITTER_DATE="+c.date, "GIT_AUTHOR_DATE="+c.date)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git commit: %v\n%s", err, output)
+		}
+	}
+
+	if err := os.Chdir("api"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := firstCommitDate(), "Sat, 1 Jan 2022 00:00:00 +0000"; got != want {
+		t.Errorf("firstCommitDate() = %q, want %q", got, want)
+	}
+}
+
+func TestWatchInputs(t *testing.T) {
+	dir := t.TempDir()
+	chart := filepath.Join(dir, "chart")
+	if err := os.Mkdir(chart, 0700); err != nil {
+		t.Fatal(err)
+	}
+	argv := &argT{Config: filepath.Join(dir, "component.toml"), Policy: filepath.Join(dir, "policy.toml"), BuildLog: filepath.Join(dir, "build.log"), ChartDir: chart}
+
+	inputs := watchInputs(argv)
+	for _, filename := range []string{argv.Policy, argv.BuildLog, filepath.Join(chart, "values.yaml")} {
+		if err := os.WriteFile(filename, []byte("changed"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		current := watchInputs(argv)
+		if current == inputs {
+			t.Errorf("watchInputs() is unchanged after writing %s", filename)
+		}
+		inputs = current
+	}
+}
+
+func TestReadPasswordEmptyStdin(t *testing.T) {
+	for _, input := range []string{"", "\n", "secret\n"} {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = w.WriteString(input)
+		w.Close()
+
+		stdin := os.Stdin
+		os.Stdin = r
+		password, err := readPassword("-")
+		os.Stdin = stdin
+		r.Close()
+
+		switch {
+		case input == "secret\n" && (err != nil || password != "secret"):
+			t.Errorf("readPassword() from %q = %q, %v, want secret", input, password, err)
+		case input != "secret\n" && err == nil:
+			t.Errorf("readPassword() from %q = %q, want an error", input, password)
+		}
+	}
+}
+
+func TestWaitForConsoleAPIBase(t *testing.T) {
+	var path string
+	console := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		if r.URL.Path != "/ortelius/api/health" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer console.Close()
+
+	consoleProxy = console.URL
+	apiBase = "/ortelius/api"
+	t.Cleanup(func() { consoleProxy, apiBase = "", "/msapi" })
+
+	if err := waitForConsole("http://console", 2*time.Second); err != nil {
+		t.Errorf("waitForConsole() = %v, last polled %s", err, path)
+	}
+}